@@ -0,0 +1,33 @@
+package cache
+
+// CoordsStore is the storage backend used by DeltaCoordsCache to persist
+// packed coord bunches. It only ever sees bunch ids and already-marshalled
+// payloads; packing/unpacking and the LRU live in DeltaCoordsCache itself.
+type CoordsStore interface {
+	// GetBunch returns the stored data for bunchId, or nil if there is none.
+	GetBunch(bunchId int64) ([]byte, error)
+	// PutBunch stores data under bunchId, overwriting any previous value.
+	PutBunch(bunchId int64, data []byte) error
+	// Iterate streams all stored bunches. The channel is closed once every
+	// bunch has been sent.
+	Iterate() <-chan CoordsBunchData
+	Close()
+}
+
+// CoordsBunchData is a single packed bunch as produced by a CoordsStore's
+// Iterate.
+type CoordsBunchData struct {
+	BunchId int64
+	Data    []byte
+}
+
+// bulkCoordsStore is implemented by CoordsStore backends that support a
+// sequential BulkLoad() fast path. DeltaCoordsCache checks for it so that
+// PutCoords can bypass the LRU entirely while it is in effect.
+type bulkCoordsStore interface {
+	CoordsStore
+	// BulkLoad switches the store into append-only, sequential-write mode.
+	BulkLoad()
+	// InBulkMode reports whether BulkLoad is currently in effect.
+	InBulkMode() bool
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	bin "encoding/binary"
+)
+
+// levelDbCoordsStore is the default CoordsStore, used by NewDeltaCoordsCache.
+// It is backed by the same embedded LevelDB handle the other caches use and
+// supports reads and writes in random order, as diff updates need. A
+// DeltaCoordsCache never switches to it from another store on its own, and
+// bunches written by a NewBulkLoadDeltaCoordsCache are not copied into it.
+type levelDbCoordsStore struct {
+	Cache
+}
+
+func newLevelDbCoordsStore(path string) (*levelDbCoordsStore, error) {
+	store := &levelDbCoordsStore{}
+	if err := store.open(path); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *levelDbCoordsStore) GetBunch(bunchId int64) ([]byte, error) {
+	keyBuf := make([]byte, 8)
+	bin.PutVarint(keyBuf, bunchId)
+	return s.db.Get(s.ro, keyBuf)
+}
+
+func (s *levelDbCoordsStore) PutBunch(bunchId int64, data []byte) error {
+	keyBuf := make([]byte, 8)
+	bin.PutVarint(keyBuf, bunchId)
+	return s.db.Put(s.wo, keyBuf, data)
+}
+
+func (s *levelDbCoordsStore) Iterate() <-chan CoordsBunchData {
+	bunches := make(chan CoordsBunchData)
+	go func() {
+		it := s.db.NewIterator(s.ro)
+		defer it.Release()
+		for it.Next() {
+			bunchId, n := bin.Varint(it.Key())
+			if n <= 0 {
+				continue
+			}
+			data := make([]byte, len(it.Value()))
+			copy(data, it.Value())
+			bunches <- CoordsBunchData{BunchId: bunchId, Data: data}
+		}
+		close(bunches)
+	}()
+	return bunches
+}
+
+func (s *levelDbCoordsStore) Close() {
+	s.Cache.Close()
+}
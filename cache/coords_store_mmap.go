@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"bufio"
+	bin "encoding/binary"
+	"os"
+	"syscall"
+)
+
+// mmapCoordsStore is a CoordsStore tuned for the initial import: bunches
+// arrive in strictly increasing bunch id order (nodes are fed to
+// PutCoords sorted by id), so BulkLoad mode just appends each bunch once
+// to a single file, recording its offset. Once the import is done the
+// file is memory-mapped and reads become simple slices into it -- no
+// LevelDB, no LRU.
+//
+// Its file does not survive a process restart: newMmapCoordsStore
+// truncates it on open. Its bunches are not copied into a
+// levelDbCoordsStore, and nothing switches a cache from this store to one.
+type mmapCoordsStore struct {
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+	offset int64
+	index  map[int64]mmapBunchPos
+	bulk   bool
+	data   []byte
+}
+
+type mmapBunchPos struct {
+	offset int64
+	length int64
+}
+
+func newMmapCoordsStore(path string) (*mmapCoordsStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &mmapCoordsStore{
+		path:   path,
+		file:   file,
+		writer: bufio.NewWriter(file),
+		index:  make(map[int64]mmapBunchPos),
+	}, nil
+}
+
+// BulkLoad switches the store into append-only, sequential-write mode.
+func (s *mmapCoordsStore) BulkLoad() {
+	s.bulk = true
+}
+
+func (s *mmapCoordsStore) InBulkMode() bool {
+	return s.bulk
+}
+
+// PutBunch appends data to the store. It only supports being called with
+// strictly increasing bunchIds, as is the case while BulkLoad is in
+// effect -- it is not a general purpose random-access store.
+//
+// It must not be called once GetBunch has triggered the switch to mmap'd
+// reads: appending past the already-mapped region would leave later
+// GetBunch calls indexing past the end of s.data. Rather than let that
+// surface as a generic out-of-range panic far from the cause, it is
+// rejected here explicitly.
+func (s *mmapCoordsStore) PutBunch(bunchId int64, data []byte) error {
+	if s.data != nil {
+		panic("mmapCoordsStore: PutBunch called after reads have switched to mmap")
+	}
+
+	lenBuf := make([]byte, bin.MaxVarintLen64)
+	n := bin.PutUvarint(lenBuf, uint64(len(data)))
+	if _, err := s.writer.Write(lenBuf[:n]); err != nil {
+		return err
+	}
+	if _, err := s.writer.Write(data); err != nil {
+		return err
+	}
+	s.index[bunchId] = mmapBunchPos{offset: s.offset + int64(n), length: int64(len(data))}
+	s.offset += int64(n) + int64(len(data))
+	return nil
+}
+
+// GetBunch returns the data for bunchId, or nil for an unknown bunchId.
+// The first call for a stored bunch flushes and memory-maps the underlying
+// file; it is meant to be called only after BulkLoad writes are done.
+func (s *mmapCoordsStore) GetBunch(bunchId int64) ([]byte, error) {
+	pos, ok := s.index[bunchId]
+	if !ok {
+		return nil, nil
+	}
+	if s.data == nil {
+		if err := s.mmap(); err != nil {
+			return nil, err
+		}
+	}
+	return s.data[pos.offset : pos.offset+pos.length], nil
+}
+
+func (s *mmapCoordsStore) Iterate() <-chan CoordsBunchData {
+	bunches := make(chan CoordsBunchData)
+	go func() {
+		for bunchId := range s.index {
+			data, err := s.GetBunch(bunchId)
+			if err != nil || data == nil {
+				continue
+			}
+			bunches <- CoordsBunchData{BunchId: bunchId, Data: data}
+		}
+		close(bunches)
+	}()
+	return bunches
+}
+
+func (s *mmapCoordsStore) mmap() error {
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	if s.offset == 0 {
+		return nil
+	}
+	data, err := syscall.Mmap(int(s.file.Fd()), 0, int(s.offset), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	s.data = data
+	return nil
+}
+
+func (s *mmapCoordsStore) Close() {
+	if s.data != nil {
+		syscall.Munmap(s.data)
+		s.data = nil
+	}
+	s.writer.Flush()
+	s.file.Close()
+}
@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	bin "encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// tempMmapPath returns a path for a temp file that doesn't exist yet
+// (newMmapCoordsStore creates/truncates it itself). Callers are
+// responsible for removing it once done.
+func tempMmapPath(t *testing.T) string {
+	f, err := ioutil.TempFile("", "imposm3-coords-")
+	if err != nil {
+		t.Fatalf("tempfile: %v", err)
+	}
+	path := f.Name()
+	f.Close()
+	os.Remove(path)
+	return path
+}
+
+func TestMmapCoordsStorePutGetBunch(t *testing.T) {
+	path := tempMmapPath(t)
+	defer os.Remove(path)
+
+	store, err := newMmapCoordsStore(path)
+	if err != nil {
+		t.Fatalf("newMmapCoordsStore: %v", err)
+	}
+	defer store.Close()
+	store.BulkLoad()
+
+	want := map[int64][]byte{
+		0: []byte("bunch-zero"),
+		1: []byte("bunch-one-has-a-longer-payload"),
+		2: []byte("x"),
+	}
+	for _, bunchId := range []int64{0, 1, 2} {
+		if err := store.PutBunch(bunchId, want[bunchId]); err != nil {
+			t.Fatalf("PutBunch(%d): %v", bunchId, err)
+		}
+	}
+
+	for bunchId, data := range want {
+		got, err := store.GetBunch(bunchId)
+		if err != nil {
+			t.Fatalf("GetBunch(%d): %v", bunchId, err)
+		}
+		if string(got) != string(data) {
+			t.Fatalf("GetBunch(%d) = %q, want %q", bunchId, got, data)
+		}
+	}
+}
+
+func TestMmapCoordsStoreMissingBunch(t *testing.T) {
+	path := tempMmapPath(t)
+	defer os.Remove(path)
+
+	store, err := newMmapCoordsStore(path)
+	if err != nil {
+		t.Fatalf("newMmapCoordsStore: %v", err)
+	}
+	defer store.Close()
+	store.BulkLoad()
+
+	if err := store.PutBunch(0, []byte("present")); err != nil {
+		t.Fatalf("PutBunch: %v", err)
+	}
+
+	got, err := store.GetBunch(42)
+	if err != nil {
+		t.Fatalf("GetBunch: %v", err)
+	}
+	if got != nil {
+		t.Fatalf("expected nil for an unknown bunch, got %q", got)
+	}
+}
+
+func TestMmapCoordsStoreIterate(t *testing.T) {
+	path := tempMmapPath(t)
+	defer os.Remove(path)
+
+	store, err := newMmapCoordsStore(path)
+	if err != nil {
+		t.Fatalf("newMmapCoordsStore: %v", err)
+	}
+	defer store.Close()
+	store.BulkLoad()
+
+	want := map[int64]string{0: "a", 1: "bb", 2: "ccc"}
+	for _, bunchId := range []int64{0, 1, 2} {
+		if err := store.PutBunch(bunchId, []byte(want[bunchId])); err != nil {
+			t.Fatalf("PutBunch: %v", err)
+		}
+	}
+
+	got := make(map[int64]string)
+	for bunch := range store.Iterate() {
+		got[bunch.BunchId] = string(bunch.Data)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Iterate returned %d bunches, want %d", len(got), len(want))
+	}
+	for bunchId, data := range want {
+		if got[bunchId] != data {
+			t.Fatalf("Iterate()[%d] = %q, want %q", bunchId, got[bunchId], data)
+		}
+	}
+}
+
+func TestMmapCoordsStorePutBunchAfterMmapPanics(t *testing.T) {
+	path := tempMmapPath(t)
+	defer os.Remove(path)
+
+	store, err := newMmapCoordsStore(path)
+	if err != nil {
+		t.Fatalf("newMmapCoordsStore: %v", err)
+	}
+	store.BulkLoad()
+	if err := store.PutBunch(0, []byte("a")); err != nil {
+		t.Fatalf("PutBunch: %v", err)
+	}
+	// the first read switches the store over to mmap'd reads.
+	if _, err := store.GetBunch(0); err != nil {
+		t.Fatalf("GetBunch: %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected PutBunch after mmap to panic")
+		}
+		store.Close()
+	}()
+	store.PutBunch(1, []byte("too-late"))
+}
+
+// TestDeltaCoordsCacheBulkLoadAcrossCalls drives the real mmap-backed
+// store end-to-end through DeltaCoordsCache.PutCoords, splitting node ids
+// across two PutCoords calls right in the middle of a coords bunch -- the
+// scenario that used to clobber the first call's partial write.
+func TestDeltaCoordsCacheBulkLoadAcrossCalls(t *testing.T) {
+	path := tempMmapPath(t)
+	defer os.Remove(path)
+
+	cache, err := NewBulkLoadDeltaCoordsCache(path)
+	if err != nil {
+		t.Fatalf("NewBulkLoadDeltaCoordsCache: %v", err)
+	}
+
+	nodes := sequentialNodes(1, 10) // ids 1-10 all fall into bunch 0
+	cache.PutCoords(nodes[:4])
+	cache.PutCoords(nodes[4:])
+	cache.Close()
+
+	data, err := readSingleMmapRecord(path)
+	if err != nil {
+		t.Fatalf("readSingleMmapRecord: %v", err)
+	}
+	deltaCoords := &DeltaCoords{}
+	if err := proto.Unmarshal(data[1:], deltaCoords); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if len(deltaCoords.Ids) != len(nodes) {
+		t.Fatalf("expected all %d nodes in the bunch, got %d -- the earlier PutCoords call's nodes were clobbered", len(nodes), len(deltaCoords.Ids))
+	}
+}
+
+// readSingleMmapRecord reads the one length-prefixed record a
+// mmapCoordsStore wrote to path, without going through
+// newMmapCoordsStore (which truncates the file on open).
+func readSingleMmapRecord(path string) ([]byte, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	length, n := bin.Uvarint(raw)
+	return raw[n : n+int(length)], nil
+}
@@ -3,7 +3,6 @@ package cache
 import (
 	"code.google.com/p/goprotobuf/proto"
 	"container/list"
-	bin "encoding/binary"
 	"goposm/binary"
 	"goposm/element"
 	"sort"
@@ -53,8 +52,8 @@ func unpackNodes(deltaCoords *DeltaCoords, nodes []element.Node) []element.Node
 
 	for i := 0; i < len(deltaCoords.Ids); i++ {
 		id = lastId + deltaCoords.Ids[i]
-		lon = lastLon + deltaCoords.Lats[i]
-		lat = lastLat + deltaCoords.Lons[i]
+		lon = lastLon + deltaCoords.Lons[i]
+		lat = lastLat + deltaCoords.Lats[i]
 		nodes[i] = element.Node{
 			OSMElem: element.OSMElem{Id: int64(id)},
 			Long:    binary.IntToCoord(uint32(lon)),
@@ -77,25 +76,51 @@ type CoordsBunch struct {
 }
 
 type DeltaCoordsCache struct {
-	Cache
+	store     CoordsStore
 	lruList   *list.List
 	table     map[int64]*CoordsBunch
 	freeNodes [][]element.Node
 	capacity  int64
 	mu        sync.Mutex
+
+	// bulk-load only: a bunch that was still open at the end of the last
+	// PutCoords call, held back until a later call proves it's complete
+	// (see putCoordsBulk).
+	bulkHasPending   bool
+	bulkPendingId    int64
+	bulkPendingNodes []element.Node
 }
 
 func NewDeltaCoordsCache(path string) (*DeltaCoordsCache, error) {
-	coordsCache := DeltaCoordsCache{}
-	err := coordsCache.open(path)
+	store, err := newLevelDbCoordsStore(path)
+	if err != nil {
+		return nil, err
+	}
+	return newDeltaCoordsCache(store), nil
+}
+
+// NewBulkLoadDeltaCoordsCache creates a DeltaCoordsCache backed by a
+// sequential, mmap-based CoordsStore. It is meant for the initial import,
+// where PutCoords is called with ever-increasing node ids: writes bypass
+// the LRU entirely and go straight to path, which is then memory-mapped
+// for reads. It must not be used for diff updates; open a regular
+// NewDeltaCoordsCache for that once the import is done.
+func NewBulkLoadDeltaCoordsCache(path string) (*DeltaCoordsCache, error) {
+	store, err := newMmapCoordsStore(path)
 	if err != nil {
 		return nil, err
 	}
+	store.BulkLoad()
+	return newDeltaCoordsCache(store), nil
+}
+
+func newDeltaCoordsCache(store CoordsStore) *DeltaCoordsCache {
+	coordsCache := &DeltaCoordsCache{store: store}
 	coordsCache.lruList = list.New()
 	coordsCache.table = make(map[int64]*CoordsBunch)
 	coordsCache.capacity = 1024 * 8
 	coordsCache.freeNodes = make([][]element.Node, 0)
-	return &coordsCache, nil
+	return coordsCache
 }
 
 func (self *DeltaCoordsCache) Close() {
@@ -104,7 +129,12 @@ func (self *DeltaCoordsCache) Close() {
 			self.putCoordsPacked(bunchId, bunch.coords)
 		}
 	}
-	self.Cache.Close()
+	if self.bulkHasPending {
+		self.putCoordsPacked(self.bulkPendingId, self.bulkPendingNodes)
+		self.bulkHasPending = false
+		self.bulkPendingNodes = nil
+	}
+	self.store.Close()
 }
 
 func (self *DeltaCoordsCache) GetCoord(id int64) (element.Node, bool) {
@@ -135,9 +165,129 @@ func (self *DeltaCoordsCache) FillWay(way *element.Way) bool {
 	return true
 }
 
+// idRef remembers where a requested id should be written back to once its
+// coords are found, so ids can be grouped and resorted by bunch without
+// losing track of the caller's original slice position.
+type idRef struct {
+	idx int
+	id  int64
+}
+
+type idRefsById []idRef
+
+func (s idRefsById) Len() int           { return len(s) }
+func (s idRefsById) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s idRefsById) Less(i, j int) bool { return s[i].id < s[j].id }
+
+// getCoordsBatch is the grouping/merge-scan lookup shared by GetCoords and
+// FillWays. It looks up len(ids) ids at once, writing found nodes into out
+// and marking found[i] for every id it located; out and found must both be
+// at least len(ids) long. It returns the number of ids that were found.
+func (self *DeltaCoordsCache) getCoordsBatch(ids []int64, out []element.Node, found []bool) int {
+	bunches := make(map[int64][]idRef)
+	for i, id := range ids {
+		bunchId := getBunchId(id)
+		bunches[bunchId] = append(bunches[bunchId], idRef{i, id})
+	}
+
+	count := 0
+	for bunchId, refs := range bunches {
+		sort.Sort(idRefsById(refs))
+		bunch := self.getBunch(bunchId)
+		i := 0
+		for _, ref := range refs {
+			for i < len(bunch.coords) && bunch.coords[i].Id < ref.id {
+				i++
+			}
+			if i < len(bunch.coords) && bunch.coords[i].Id == ref.id {
+				out[ref.idx] = bunch.coords[i]
+				found[ref.idx] = true
+				count++
+			}
+		}
+		bunch.Unlock()
+	}
+
+	return count
+}
+
+// GetCoords looks up len(ids) coords at once, writing found nodes into the
+// matching position of out (out must be at least len(ids) long). Unlike
+// calling GetCoord per id, ids are first grouped by the bunch they fall
+// into, so a bunch is locked and its coords read exactly once no matter
+// how many of the requested ids live in it, and each group is resolved
+// with a single merge-style scan over the bunch's already-sorted coords
+// instead of a binary search per id. It returns the number of ids that
+// were found and whether all of them were.
+func (self *DeltaCoordsCache) GetCoords(ids []int64, out []element.Node) (int, bool) {
+	found := make([]bool, len(ids))
+	count := self.getCoordsBatch(ids, out, found)
+	return count, count == len(ids)
+}
+
+// refPos is a way's ref, identified by its position within ways/way.Refs.
+type refPos struct {
+	wayIdx, refIdx int
+}
+
+// FillWays fills the Nodes field for every way in ways, the way GetCoords
+// fills ids: refs are grouped by bunch across all ways first, so a bunch
+// shared by many ways -- or referenced many times within one way, as with
+// closed polygons and coastlines -- is locked and scanned only once,
+// instead of once per ref as repeated FillWay calls would.
+//
+// It mirrors FillWay's per-way bool result instead of one aggregate error:
+// the returned slice reports success for each way in ways, in order. A way
+// with any dangling ref -- common on bbox-clipped extracts, where
+// coastlines/polygons refer to nodes outside the box -- has its Nodes
+// cleared instead of being left with spliced-in zero-value nodes, so
+// callers can tell which ways to drop the same way they would after a
+// failed FillWay.
+func (self *DeltaCoordsCache) FillWays(ways []*element.Way) []bool {
+	ok := make([]bool, len(ways))
+	var ids []int64
+	var positions []refPos
+	for wi, way := range ways {
+		if way == nil {
+			continue
+		}
+		ok[wi] = true
+		way.Nodes = make([]element.Node, len(way.Refs))
+		for ri, id := range way.Refs {
+			ids = append(ids, id)
+			positions = append(positions, refPos{wi, ri})
+		}
+	}
+
+	out := make([]element.Node, len(ids))
+	found := make([]bool, len(ids))
+	self.getCoordsBatch(ids, out, found)
+
+	for i, pos := range positions {
+		if found[i] {
+			ways[pos.wayIdx].Nodes[pos.refIdx] = out[i]
+		} else {
+			ok[pos.wayIdx] = false
+		}
+	}
+
+	for wi, way := range ways {
+		if way != nil && !ok[wi] {
+			way.Nodes = nil
+		}
+	}
+
+	return ok
+}
+
 // PutCoords puts nodes into cache.
 // nodes need to be sorted by Id.
 func (self *DeltaCoordsCache) PutCoords(nodes []element.Node) {
+	if bulk, ok := self.store.(bulkCoordsStore); ok && bulk.InBulkMode() {
+		self.putCoordsBulk(nodes)
+		return
+	}
+
 	var start, currentBunchId int64
 	currentBunchId = getBunchId(nodes[0].Id)
 	start = 0
@@ -163,26 +313,104 @@ func (self *DeltaCoordsCache) PutCoords(nodes []element.Node) {
 	bunch.Unlock()
 }
 
+// putCoordsBulk streams packed bunches straight to self.store, without
+// ever touching lruList/table. It relies on nodes being sorted by id (as
+// PutCoords always requires, across calls as well as within one), so each
+// bunch id is only ever growing.
+//
+// Import pipelines batch calls to PutCoords with no relation to the
+// 64-id bunch boundary, so the last bunch seen in a call is often still
+// incomplete -- a later call may still add more nodes to it. That bunch
+// is held in bulkPendingNodes instead of being written immediately. It is
+// only written once a node for a later bunch proves it's done (by
+// putCoordsBulk or flushBulkBunch), or by Close once nothing more is coming.
+func (self *DeltaCoordsCache) putCoordsBulk(nodes []element.Node) {
+	if len(nodes) == 0 {
+		return
+	}
+
+	start := 0
+	currentBunchId := getBunchId(nodes[0].Id)
+
+	if self.bulkHasPending && self.bulkPendingId != currentBunchId {
+		// ids only increase, so the pending bunch will never see more
+		// nodes now -- it's complete.
+		self.putCoordsPacked(self.bulkPendingId, self.bulkPendingNodes)
+		self.bulkHasPending = false
+		self.bulkPendingNodes = nil
+	}
+
+	for i, node := range nodes {
+		bunchId := getBunchId(node.Id)
+		if bunchId != currentBunchId {
+			self.flushBulkBunch(currentBunchId, nodes[start:i])
+			currentBunchId = bunchId
+			start = i
+		}
+	}
+
+	self.bulkPendingNodes = append(self.bulkPendingNodes, nodes[start:]...)
+	self.bulkPendingId = currentBunchId
+	self.bulkHasPending = true
+}
+
+// flushBulkBunch writes bunchId's packed bunch, first prepending any
+// nodes left pending from an earlier PutCoords call that belong to the
+// same bunch. A bunch can only ever be split across the boundary between
+// two PutCoords calls, never within one, since nodes arrive sorted by id.
+func (self *DeltaCoordsCache) flushBulkBunch(bunchId int64, nodes []element.Node) {
+	if self.bulkHasPending && self.bulkPendingId == bunchId {
+		nodes = append(self.bulkPendingNodes, nodes...)
+		self.bulkHasPending = false
+		self.bulkPendingNodes = nil
+	}
+	self.putCoordsPacked(bunchId, nodes)
+}
+
+const (
+	// coordsFormatLegacyTag is not a real format version: bunches stored
+	// before this versioning existed are raw protobuf with no prefix
+	// byte at all. They always start with 0x0a, the tag byte for their
+	// non-empty, length-delimited Ids field (field 1), which is always
+	// present since putCoordsPacked never stores an empty bunch. Real
+	// version bytes below are kept out of that value so the two can't
+	// collide.
+	//
+	// packNodes itself never had the lat/lon swap bug -- only the old
+	// unpackNodes did -- so legacy records decode fine with today's
+	// unpackNodes; the only thing the tag changes is where the
+	// protobuf payload starts (byte 0, vs. byte 1 once the format byte
+	// is there).
+	coordsFormatLegacyTag = 0x0a
+
+	// coordsFormatDeltaV1 is the current format: a DeltaCoords protobuf,
+	// prefixed with this byte.
+	coordsFormatDeltaV1 = 0x01
+
+	currentCoordsFormat = coordsFormatDeltaV1
+)
+
 func (p *DeltaCoordsCache) putCoordsPacked(bunchId int64, nodes []element.Node) {
 	if len(nodes) == 0 {
 		return
 	}
-	keyBuf := make([]byte, 8)
-	bin.PutVarint(keyBuf, bunchId)
 
 	deltaCoords := packNodes(nodes)
-	data, err := proto.Marshal(deltaCoords)
+	payload, err := proto.Marshal(deltaCoords)
 	if err != nil {
 		panic(err)
 	}
-	p.db.Put(p.wo, keyBuf, data)
+	data := make([]byte, 1+len(payload))
+	data[0] = currentCoordsFormat
+	copy(data[1:], payload)
+
+	if err := p.store.PutBunch(bunchId, data); err != nil {
+		panic(err)
+	}
 }
 
 func (p *DeltaCoordsCache) getCoordsPacked(bunchId int64, nodes []element.Node) []element.Node {
-	keyBuf := make([]byte, 8)
-	bin.PutVarint(keyBuf, bunchId)
-
-	data, err := p.db.Get(p.ro, keyBuf)
+	data, err := p.store.GetBunch(bunchId)
 	if err != nil {
 		panic(err)
 	}
@@ -190,13 +418,24 @@ func (p *DeltaCoordsCache) getCoordsPacked(bunchId int64, nodes []element.Node)
 		// clear before returning
 		return nodes[:0]
 	}
+
+	legacy := data[0] == coordsFormatLegacyTag
+	payload := data
+	if !legacy {
+		payload = data[1:]
+	}
+
 	deltaCoords := &DeltaCoords{}
-	err = proto.Unmarshal(data, deltaCoords)
-	if err != nil {
+	if err := proto.Unmarshal(payload, deltaCoords); err != nil {
 		panic(err)
 	}
-
 	nodes = unpackNodes(deltaCoords, nodes)
+
+	if legacy {
+		// rewrite in the current, prefixed format so this bunch only
+		// needs to be sniffed for the missing prefix once.
+		p.putCoordsPacked(bunchId, nodes)
+	}
 	return nodes
 }
 
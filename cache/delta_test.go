@@ -0,0 +1,185 @@
+package cache
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"goposm/element"
+	"testing"
+)
+
+// fakeCoordsStore is an in-memory CoordsStore used to exercise
+// DeltaCoordsCache without a real LevelDB handle.
+type fakeCoordsStore struct {
+	data map[int64][]byte
+}
+
+func newFakeCoordsStore() *fakeCoordsStore {
+	return &fakeCoordsStore{data: make(map[int64][]byte)}
+}
+
+func (s *fakeCoordsStore) GetBunch(bunchId int64) ([]byte, error) {
+	return s.data[bunchId], nil
+}
+
+func (s *fakeCoordsStore) PutBunch(bunchId int64, data []byte) error {
+	s.data[bunchId] = data
+	return nil
+}
+
+func (s *fakeCoordsStore) Iterate() <-chan CoordsBunchData {
+	bunches := make(chan CoordsBunchData, len(s.data))
+	for bunchId, data := range s.data {
+		bunches <- CoordsBunchData{BunchId: bunchId, Data: data}
+	}
+	close(bunches)
+	return bunches
+}
+
+func (s *fakeCoordsStore) Close() {}
+
+// sequentialNodes builds n nodes with consecutive ids starting at
+// startId, walking the coordinate by a small step per node so deltas are
+// non-zero in both directions -- close to what a real way/coastline looks
+// like.
+func sequentialNodes(startId int64, n int) []element.Node {
+	nodes := make([]element.Node, n)
+	for i := 0; i < n; i++ {
+		nodes[i] = element.Node{
+			OSMElem: element.OSMElem{Id: startId + int64(i)},
+			Long:    float64(i) * 0.001,
+			Lat:     50.0 + float64(i)*0.002,
+		}
+	}
+	return nodes
+}
+
+func TestGetCoords(t *testing.T) {
+	cache := newDeltaCoordsCache(newFakeCoordsStore())
+	nodes := sequentialNodes(1, 8)
+	cache.PutCoords(nodes)
+
+	ids := []int64{nodes[0].Id, nodes[3].Id, nodes[7].Id, 999}
+	out := make([]element.Node, len(ids))
+	found, ok := cache.GetCoords(ids, out)
+
+	if found != 3 {
+		t.Fatalf("expected 3 coords found, got %d", found)
+	}
+	if ok {
+		t.Fatalf("expected ok=false with a missing id")
+	}
+	if out[0] != nodes[0] || out[1] != nodes[3] || out[2] != nodes[7] {
+		t.Fatalf("unexpected coords: %v", out)
+	}
+}
+
+func TestFillWays(t *testing.T) {
+	cache := newDeltaCoordsCache(newFakeCoordsStore())
+	nodes := sequentialNodes(1, 8)
+	cache.PutCoords(nodes)
+
+	wayA := &element.Way{Refs: []int64{nodes[0].Id, nodes[1].Id, nodes[2].Id}}
+	wayB := &element.Way{Refs: []int64{nodes[2].Id, nodes[3].Id, nodes[0].Id}}
+
+	ok := cache.FillWays([]*element.Way{wayA, wayB})
+	if !ok[0] || !ok[1] {
+		t.Fatalf("expected both ways filled, got %v", ok)
+	}
+	if wayA.Nodes[0] != nodes[0] || wayA.Nodes[2] != nodes[2] {
+		t.Fatalf("wayA not filled correctly: %v", wayA.Nodes)
+	}
+	if wayB.Nodes[0] != nodes[2] || wayB.Nodes[2] != nodes[0] {
+		t.Fatalf("wayB not filled correctly: %v", wayB.Nodes)
+	}
+}
+
+func TestFillWaysDanglingRef(t *testing.T) {
+	cache := newDeltaCoordsCache(newFakeCoordsStore())
+	nodes := sequentialNodes(1, 4)
+	cache.PutCoords(nodes)
+
+	good := &element.Way{Refs: []int64{nodes[0].Id, nodes[1].Id}}
+	// a bbox-clipped coastline: one ref points outside the imported area.
+	dangling := &element.Way{Refs: []int64{nodes[0].Id, 12345}}
+
+	ok := cache.FillWays([]*element.Way{good, dangling})
+	if !ok[0] {
+		t.Fatalf("expected good way to fill successfully")
+	}
+	if ok[1] {
+		t.Fatalf("expected way with dangling ref to fail")
+	}
+	if dangling.Nodes != nil {
+		t.Fatalf("expected dangling way's Nodes to be cleared, got %v", dangling.Nodes)
+	}
+}
+
+// TestLegacyCoordsFormatRoundTrip stores a bunch the way the pre-fix
+// putCoordsPacked did -- a plain DeltaCoords protobuf with no format
+// prefix, produced by the never-buggy packNodes -- and checks that
+// getCoordsPacked detects the missing prefix, decodes it to the original
+// coordinates, and rewrites it in the current, prefixed format.
+func TestLegacyCoordsFormatRoundTrip(t *testing.T) {
+	store := newFakeCoordsStore()
+	cache := newDeltaCoordsCache(store)
+
+	nodes := sequentialNodes(1, 5)
+	bunchId := getBunchId(nodes[0].Id)
+
+	legacyData, err := proto.Marshal(packNodes(nodes))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	store.data[bunchId] = legacyData
+
+	got, ok := cache.GetCoord(nodes[2].Id)
+	if !ok {
+		t.Fatalf("expected to find legacy coord")
+	}
+	if got != nodes[2] {
+		t.Fatalf("legacy coord decoded wrong: got %v, want %v", got, nodes[2])
+	}
+
+	rewritten := store.data[bunchId]
+	if rewritten[0] != currentCoordsFormat {
+		t.Fatalf("expected legacy bunch to be rewritten with the current format byte, got %#x", rewritten[0])
+	}
+}
+
+func BenchmarkFillWays(b *testing.B) {
+	cache := newDeltaCoordsCache(newFakeCoordsStore())
+	// a coastline-sized way: a few thousand nodes, many of which share
+	// the same coords bunch.
+	nodes := sequentialNodes(1, 4000)
+	cache.PutCoords(nodes)
+
+	refs := make([]int64, len(nodes))
+	for i, nd := range nodes {
+		refs[i] = nd.Id
+	}
+	// closed polygon: first node repeated at the end, like a coastline.
+	refs = append(refs, refs[0])
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		way := &element.Way{Refs: refs}
+		cache.FillWays([]*element.Way{way})
+	}
+}
+
+func BenchmarkFillWay(b *testing.B) {
+	cache := newDeltaCoordsCache(newFakeCoordsStore())
+	nodes := sequentialNodes(1, 4000)
+	cache.PutCoords(nodes)
+
+	refs := make([]int64, len(nodes))
+	for i, nd := range nodes {
+		refs[i] = nd.Id
+	}
+	refs = append(refs, refs[0])
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		way := &element.Way{Refs: refs}
+		cache.FillWay(way)
+	}
+}